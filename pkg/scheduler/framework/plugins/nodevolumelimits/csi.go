@@ -0,0 +1,863 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodevolumelimits
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/rand"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	csitrans "k8s.io/csi-translation-lib"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	volumeutil "k8s.io/kubernetes/pkg/volume/util"
+)
+
+// CSIName is the name of the plugin used in the plugin registry and configurations.
+const CSIName = "CSILimits"
+
+// ErrReasonMaxVolumeCountExceeded is used to create predicate failure message.
+const ErrReasonMaxVolumeCountExceeded = "node(s) exceed max volume count"
+
+// ErrReasonVolumeLifecycleUnsupported is used when a driver's CSIDriver object
+// doesn't advertise support for the volume lifecycle mode (Persistent or
+// Ephemeral) a pod is trying to use it with.
+const ErrReasonVolumeLifecycleUnsupported = "driver does not support the requested volume lifecycle mode"
+
+// ErrReasonVolumeExpansionUnsupported is used when a PVC undergoing an in-flight
+// modification that requires volume expansion is moving to a StorageClass that
+// doesn't allow it.
+const ErrReasonVolumeExpansionUnsupported = "target StorageClass does not support volume expansion"
+
+// PVCs undergoing an in-flight VolumeAttributesClass change or resize that moves them
+// onto a different StorageClass (as tracked by external volume-modification
+// controllers) carry these annotations so CSILimits can charge the volume to the
+// driver it is migrating to, rather than the one its currently-bound PV reports.
+const (
+	// pvcModifyVolumeTargetStorageClassAnnotationKey names the StorageClass a PVC's
+	// in-flight modification is moving it to.
+	pvcModifyVolumeTargetStorageClassAnnotationKey = "volume.kubernetes.io/modify-volume-target-storage-class"
+	// pvcModifyVolumeRequiresExpansionAnnotationKey, set to "true", indicates the
+	// in-flight modification requires the target StorageClass to support expansion.
+	pvcModifyVolumeRequiresExpansionAnnotationKey = "volume.kubernetes.io/modify-volume-requires-expansion"
+)
+
+// maxVolumesPerNodeAnnotationKey, set on a StorageClass, caps the number of volumes
+// provisioned from that class on each node. The cap is counted separately from, and
+// enforced in addition to, the driver's max-volumes-per-node limit, so it can hold a
+// particular class (e.g. a slow archive class) below the driver's node-wide limit but
+// cannot raise the class above that limit.
+const maxVolumesPerNodeAnnotationKey = "scheduler.alpha.kubernetes.io/max-volumes-per-node"
+
+// classVolumeLimitAnnotationPrefix prefixes a well-known CSINode annotation that caps
+// the number of volumes provisioned from a specific StorageClass schedulable to that
+// node, e.g. "volume-limits.storage.k8s.io/class.fast-ssd": "5". Unlike
+// maxVolumesPerNodeAnnotationKey, which is set once on the StorageClass and applies to
+// every node the same way, this lets an operator give individual nodes a different
+// per-class cap, the same way CSINode.Spec.Drivers[].Allocatable.Count already lets a
+// node override a driver's node-wide limit.
+const classVolumeLimitAnnotationPrefix = "volume-limits.storage.k8s.io/class."
+
+// classVolumeLimitAnnotationKey returns the CSINode annotation key that caps volumes
+// provisioned from StorageClass scName on that node.
+func classVolumeLimitAnnotationKey(scName string) string {
+	return classVolumeLimitAnnotationPrefix + scName
+}
+
+// Volume filter type names for the in-tree plugins that predate CSI and still
+// report their limits via a well-known node.Status.Allocatable resource name
+// rather than through CSINode.
+const (
+	ebsVolumeFilterType       = "aws-ebs"
+	gcePDVolumeFilterType     = "gce-pd"
+	azureDiskVolumeFilterType = "azure-disk"
+	cinderVolumeFilterType    = "cinder"
+)
+
+// ScoringStrategyType is the type of strategy used by the Score extension of CSILimits
+// to turn spare attach capacity into a node score, mirroring NodeResourcesFit's
+// ScoringStrategyType.
+type ScoringStrategyType string
+
+const (
+	// LeastAllocated favors nodes with the most unused attach capacity for the
+	// drivers the incoming pod uses.
+	LeastAllocated ScoringStrategyType = "LeastAllocated"
+	// MostAllocated favors nodes with the least unused attach capacity, packing
+	// volume attachments onto already-busy nodes.
+	MostAllocated ScoringStrategyType = "MostAllocated"
+)
+
+// CSILimitsArgs holds the arguments used to configure the CSILimits plugin.
+//
+// NOTE: unlike the *Args types of most in-tree plugins, this one is not registered
+// with the scheduler's component config API (no apis/config type, no scheme
+// registration, no conversion/defaulting/validation), so the scheduler config decoder
+// can never produce one: there is no way to select ScoringStrategy from a
+// KubeSchedulerConfiguration file. A *CSILimitsArgs only takes effect when something
+// in-process constructs one and passes it to NewCSI directly (as the tests do).
+// Until the args type is registered end-to-end, treat ScoringStrategy as a build-time
+// knob, not a user-facing scheduler config option.
+type CSILimitsArgs struct {
+	// ScoringStrategy selects how per-driver spare capacity is turned into a
+	// node score. Defaults to LeastAllocated, which spreads volume attachments
+	// across nodes.
+	ScoringStrategy ScoringStrategyType
+}
+
+// InTreeToCSITranslator is the subset of k8s.io/csi-translation-lib's Translator
+// interface that CSILimits needs in order to reason about in-tree volumes that
+// are migrated to a CSI driver.
+type InTreeToCSITranslator interface {
+	TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.PersistentVolume, error)
+	TranslateInTreeInlineVolumeToCSI(volume *v1.Volume, podNamespace string) (*v1.PersistentVolume, error)
+	IsPVMigratable(pv *v1.PersistentVolume) bool
+	IsInlineMigratable(vol *v1.Volume) bool
+	IsMigratableIntreePluginByName(inTreePluginName string) bool
+	GetInTreePluginNameFromSpec(pv *v1.PersistentVolume, vol *v1.Volume) (string, error)
+	GetCSINameFromInTreeName(pluginName string) (string, error)
+}
+
+// CSILimits is a plugin that checks and scores node volume attach limits.
+type CSILimits struct {
+	csiNodeLister          storagelisters.CSINodeLister
+	csiDriverLister        storagelisters.CSIDriverLister
+	volumeAttachmentLister storagelisters.VolumeAttachmentLister
+	pvLister               corelisters.PersistentVolumeLister
+	pvcLister              corelisters.PersistentVolumeClaimLister
+	scLister               storagelisters.StorageClassLister
+
+	randomVolumeIDPrefix string
+
+	translator InTreeToCSITranslator
+
+	scoringStrategy ScoringStrategyType
+
+	handle framework.Handle
+}
+
+var (
+	_ framework.PreFilterPlugin   = &CSILimits{}
+	_ framework.FilterPlugin      = &CSILimits{}
+	_ framework.EnqueueExtensions = &CSILimits{}
+	_ framework.ScorePlugin       = &CSILimits{}
+	_ framework.ScoreExtensions   = &CSILimits{}
+)
+
+// Name returns name of the plugin. It is used in logs, etc.
+func (pl *CSILimits) Name() string {
+	return CSIName
+}
+
+// EventsToRegister returns the possible events that may make a Pod
+// failed by this plugin schedulable.
+func (pl *CSILimits) EventsToRegister() []framework.ClusterEventWithHint {
+	return []framework.ClusterEventWithHint{
+		{Event: framework.ClusterEvent{Resource: framework.CSINode, ActionType: framework.Add | framework.Update}},
+		{Event: framework.ClusterEvent{Resource: framework.Pod, ActionType: framework.Delete}},
+		{Event: framework.ClusterEvent{Resource: framework.PersistentVolumeClaim, ActionType: framework.Add | framework.Update}},
+	}
+}
+
+// PreFilter invoked at the prefilter extension point.
+//
+// If the pod doesn't use any volumes this plugin cares about, Filter (and Score)
+// are skipped for it entirely. This is a cheap, local check of the pod spec: it
+// does not resolve PVCs to drivers, so it cannot fail.
+func (pl *CSILimits) PreFilter(ctx context.Context, _ *framework.CycleState, pod *v1.Pod) (*framework.PreFilterResult, *framework.Status) {
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil || vol.Ephemeral != nil || pl.translator.IsInlineMigratable(&vol) {
+			return nil, nil
+		}
+	}
+	return nil, framework.NewStatus(framework.Skip)
+}
+
+// PreFilterExtensions returns prefilter extensions, pod add and remove.
+func (pl *CSILimits) PreFilterExtensions() framework.PreFilterExtensions {
+	return nil
+}
+
+// Filter invoked at the filter extension point.
+func (pl *CSILimits) Filter(ctx context.Context, _ *framework.CycleState, pod *v1.Pod, nodeInfo *framework.NodeInfo) *framework.Status {
+	node := nodeInfo.Node()
+	if node == nil {
+		return framework.NewStatus(framework.Error, "node not found")
+	}
+
+	csiNode, _ := pl.csiNodeLister.Get(node.Name)
+
+	newVolumes, status := pl.filterAttachableVolumes(pod, csiNode)
+	if !status.IsSuccess() {
+		return status
+	}
+	if len(newVolumes) == 0 {
+		return nil
+	}
+
+	attachedVolumes := make(map[string]resolvedVolume)
+	for _, existingPod := range nodeInfo.Pods {
+		// A lifecycle-mode or pending-modification failure resolving an already-scheduled
+		// neighbor's volumes is that pod's problem, not the incoming pod's: it must not make
+		// the incoming pod Unschedulable(AndUnresolvable) for volumes it doesn't even use.
+		// Just don't count that neighbor's volumes towards the limit, the same way score()
+		// already does below.
+		existingVolumes, status := pl.filterAttachableVolumes(existingPod.Pod, csiNode)
+		if !status.IsSuccess() {
+			continue
+		}
+		for volumeHandle, rv := range existingVolumes {
+			attachedVolumes[volumeHandle] = rv
+		}
+	}
+
+	// Pods in nodeInfo only reflect what's currently scheduled to the node; a VolumeAttachment
+	// can outlive the pod that requested it (e.g. still draining after the pod was deleted) or
+	// exist for an RWX volume attached from a pod running elsewhere. Union those in too, keyed
+	// by volume handle so a volume covered by both sources isn't double-counted.
+	for volumeHandle, driverName := range pl.attachedVolumesFromVolumeAttachments(node.Name) {
+		if _, ok := attachedVolumes[volumeHandle]; !ok {
+			attachedVolumes[volumeHandle] = resolvedVolume{driverName: driverName}
+		}
+	}
+
+	attachedVolumeCount := map[string]int{}
+	attachedSCCount := map[string]int{}
+	for volumeHandle, rv := range attachedVolumes {
+		if _, ok := newVolumes[volumeHandle]; ok {
+			// Don't count a volume already used by the incoming pod more than once.
+			continue
+		}
+		attachedVolumeCount[rv.driverName]++
+		if rv.storageClassName != "" {
+			attachedSCCount[rv.storageClassName]++
+		}
+	}
+
+	newVolumeCount := map[string]int{}
+	newSCCount := map[string]int{}
+	for _, rv := range newVolumes {
+		newVolumeCount[rv.driverName]++
+		if rv.storageClassName != "" {
+			newSCCount[rv.storageClassName]++
+		}
+	}
+
+	for driverName, count := range newVolumeCount {
+		maxVolumeLimit, ok := pl.driverVolumeLimit(node, csiNode, driverName)
+		if !ok {
+			continue
+		}
+		if int64(count+attachedVolumeCount[driverName]) > maxVolumeLimit {
+			return framework.NewStatus(framework.Unschedulable, ErrReasonMaxVolumeCountExceeded)
+		}
+	}
+
+	for scName, count := range newSCCount {
+		maxSCLimit, ok := pl.storageClassVolumeLimit(csiNode, scName)
+		if !ok {
+			continue
+		}
+		if int64(count+attachedSCCount[scName]) > maxSCLimit {
+			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("%s: StorageClass %q exceeds its max-volumes-per-node cap", ErrReasonMaxVolumeCountExceeded, scName))
+		}
+	}
+
+	return nil
+}
+
+// resolvedVolume is what a pod's volume resolves to for limit-counting purposes: the
+// CSI driver attaching it, and, for PVC-backed volumes, the StorageClass it was
+// provisioned from (empty for inline/migrated volumes, which have no StorageClass).
+type resolvedVolume struct {
+	driverName       string
+	storageClassName string
+}
+
+// filterAttachableVolumes resolves every CSI-attachable volume used by pod (PVC-backed,
+// generic ephemeral, or migrated in-tree inline) to its driver and StorageClass,
+// returning a map keyed by a name that uniquely identifies the volume (its VolumeHandle
+// when known).
+func (pl *CSILimits) filterAttachableVolumes(pod *v1.Pod, csiNode *storagev1.CSINode) (map[string]resolvedVolume, *framework.Status) {
+	result := make(map[string]resolvedVolume)
+	for _, vol := range pod.Spec.Volumes {
+		pvcName := ""
+		isEphemeral := false
+		switch {
+		case vol.PersistentVolumeClaim != nil:
+			pvcName = vol.PersistentVolumeClaim.ClaimName
+		case vol.Ephemeral != nil:
+			pvcName = pod.Name + "-" + vol.Name
+			isEphemeral = true
+		default:
+			driverName, volumeHandle := pl.translateInTreeInlineVolumeToCSI(pod, vol)
+			if driverName != "" {
+				// translateInTreeInlineVolumeToCSI only ever resolves a migrated in-tree
+				// inline volume (e.g. AWSElasticBlockStore); this plugin doesn't handle
+				// true CSI inline volumes (vol.CSI). Migrated inline volumes are attached
+				// as ordinary persistent CSI attachments, so the driver must support
+				// Persistent, not Ephemeral.
+				if status := pl.checkVolumeLifecycleMode(driverName, storagev1.VolumeLifecyclePersistent); !status.IsSuccess() {
+					return nil, status
+				}
+				result[volumeHandle] = resolvedVolume{driverName: driverName}
+			}
+			continue
+		}
+
+		pvc, err := pl.pvcLister.PersistentVolumeClaims(pod.Namespace).Get(pvcName)
+		if err != nil {
+			if !isEphemeral {
+				continue
+			}
+			// The ephemeral controller hasn't materialized this volume's PVC yet. Resolve
+			// the driver from the pod-embedded VolumeClaimTemplate's StorageClass instead,
+			// the same way an unbound regular PVC falls back to its StorageClass.
+			driverName, volumeHandle, scName, ok := pl.ephemeralVolumeFromTemplate(csiNode, pod.Namespace, pvcName, vol.Ephemeral)
+			if !ok {
+				return nil, framework.AsStatus(fmt.Errorf("looking up PVC %s/%s: %v", pod.Namespace, pvcName, err))
+			}
+			if status := pl.checkVolumeLifecycleMode(driverName, storagev1.VolumeLifecycleEphemeral); !status.IsSuccess() {
+				return nil, status
+			}
+			result[volumeHandle] = resolvedVolume{driverName: driverName, storageClassName: scName}
+			continue
+		}
+
+		if isEphemeral && !isPodOwnerOfClaim(pod, pvc) {
+			return nil, framework.AsStatus(fmt.Errorf("PVC %s/%s was not created for pod %s/%s (pod is not owner)", pvc.Namespace, pvc.Name, pod.Namespace, pod.Name))
+		}
+
+		driverName, volumeHandle := pl.getCSIDriverInfo(csiNode, pvc)
+		if driverName == "" || volumeHandle == "" {
+			klog.V(5).InfoS("Could not find a CSI driver name or volume handle, not counting volume")
+			continue
+		}
+
+		wantMode := storagev1.VolumeLifecyclePersistent
+		if isEphemeral {
+			wantMode = storagev1.VolumeLifecycleEphemeral
+		}
+		if status := pl.checkVolumeLifecycleMode(driverName, wantMode); !status.IsSuccess() {
+			return nil, status
+		}
+
+		scName := ""
+		if pvc.Spec.StorageClassName != nil {
+			scName = *pvc.Spec.StorageClassName
+		}
+
+		if targetSCName, requiresExpansion, inFlight := pendingVolumeModificationTarget(pvc); inFlight {
+			targetDriverName, status := pl.resolveModificationTarget(csiNode, pvc, targetSCName, requiresExpansion)
+			if !status.IsSuccess() {
+				return nil, status
+			}
+			if targetDriverName != "" {
+				driverName, scName = targetDriverName, targetSCName
+			}
+		}
+
+		result[volumeHandle] = resolvedVolume{driverName: driverName, storageClassName: scName}
+	}
+	return result, nil
+}
+
+// checkVolumeLifecycleMode verifies that the CSIDriver registered for driverName
+// advertises support for mode (Persistent for PVC-backed volumes, Ephemeral for
+// inline CSI volumes and generic ephemeral volumes). A driver with no CSIDriver
+// object registered, or whose CSIDriver lists no lifecycle modes, is treated as
+// supporting every mode.
+func (pl *CSILimits) checkVolumeLifecycleMode(driverName string, mode storagev1.VolumeLifecycleMode) *framework.Status {
+	if pl.csiDriverLister == nil {
+		return nil
+	}
+	driver, err := pl.csiDriverLister.Get(driverName)
+	if err != nil {
+		return nil
+	}
+	if len(driver.Spec.VolumeLifecycleModes) == 0 {
+		return nil
+	}
+	for _, m := range driver.Spec.VolumeLifecycleModes {
+		if m == mode {
+			return nil
+		}
+	}
+	return framework.NewStatus(framework.UnschedulableAndUnresolvable,
+		fmt.Sprintf("%s: driver %q does not support volume lifecycle mode %q", ErrReasonVolumeLifecycleUnsupported, driverName, mode))
+}
+
+// isPodOwnerOfClaim reports whether pod is listed as a controller owner of pvc, which is how
+// generic ephemeral volumes tie their auto-generated PVC back to the pod that owns its lifecycle.
+func isPodOwnerOfClaim(pod *v1.Pod, pvc *v1.PersistentVolumeClaim) bool {
+	for _, ref := range pvc.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller && ref.Kind == "Pod" && ref.UID == pod.UID && ref.Name == pod.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// getCSIDriverInfo returns the CSI driver name and volume ID for a given PVC. If the PVC
+// is not bound yet, its StorageClass is used to look up the driver so that in-flight
+// (not yet bound) volumes are still counted against limits.
+func (pl *CSILimits) getCSIDriverInfo(csiNode *storagev1.CSINode, pvc *v1.PersistentVolumeClaim) (string, string) {
+	pvName := pvc.Spec.VolumeName
+	namespace := pvc.Namespace
+
+	if pvName == "" {
+		klog.V(5).InfoS("Persistent volume had no name for claim", "PVC", klog.KObj(pvc))
+		return pl.getCSIDriverInfoFromSC(csiNode, pvc)
+	}
+
+	pv, err := pl.pvLister.Get(pvName)
+	if err != nil {
+		klog.V(5).InfoS("Unable to look up PV info for PVC and PV", "PVC", klog.KObj(pvc), "PV", klog.KRef(namespace, pvName))
+		return pl.getCSIDriverInfoFromSC(csiNode, pvc)
+	}
+
+	csiSource := pv.Spec.PersistentVolumeSource.CSI
+	if csiSource == nil {
+		if pl.translator.IsPVMigratable(pv) {
+			driverName, err := pl.translator.GetInTreePluginNameFromSpec(pv, nil)
+			if err != nil {
+				klog.V(5).InfoS("Unable to look up plugin name from PV spec", "err", err)
+				return "", ""
+			}
+
+			if !isCSIMigrationOn(csiNode, driverName) {
+				klog.V(5).InfoS("CSI Migration of plugin is not enabled", "plugin", driverName)
+				return "", ""
+			}
+
+			pluginSrc, err := pl.translator.TranslateInTreePVToCSI(pv)
+			if err != nil {
+				klog.V(5).InfoS("Unable to translate in-tree volume to CSI", "err", err)
+				return "", ""
+			}
+
+			if pluginSrc.Spec.PersistentVolumeSource.CSI == nil {
+				klog.V(5).InfoS("Unable to get a valid volume source for translated PV")
+				return "", ""
+			}
+
+			csiSource = pluginSrc.Spec.PersistentVolumeSource.CSI
+		} else {
+			klog.V(5).InfoS("Not considering non-CSI volume", "PV", klog.KRef(namespace, pvName))
+			return "", ""
+		}
+	}
+
+	return csiSource.Driver, csiSource.VolumeHandle
+}
+
+// getCSIDriverInfoFromSC returns the CSI driver name and a synthesized, unique volume handle
+// for a PVC that has not been bound to a PV yet.
+func (pl *CSILimits) getCSIDriverInfoFromSC(csiNode *storagev1.CSINode, pvc *v1.PersistentVolumeClaim) (string, string) {
+	namespace := pvc.Namespace
+	pvcName := pvc.Name
+
+	scName := ""
+	if pvc.Spec.StorageClassName != nil {
+		scName = *pvc.Spec.StorageClassName
+	}
+	if scName == "" {
+		klog.V(5).InfoS("PVC has no StorageClass", "PVC", klog.KObj(pvc))
+		return "", ""
+	}
+
+	storageClass, err := pl.scLister.Get(scName)
+	if err != nil {
+		klog.V(5).InfoS("Could not get StorageClass for PVC", "PVC", klog.KObj(pvc), "err", err)
+		return "", ""
+	}
+
+	// We use a random prefix to avoid conflicting with volume IDs used elsewhere. If the PVC
+	// becomes bound while this predicate runs and another pod on the node uses the same volume,
+	// we will temporarily overcount, which is the conservative (safe) direction to err in.
+	volumeHandle := fmt.Sprintf("%s-%s/%s", pl.randomVolumeIDPrefix, namespace, pvcName)
+
+	driverName, ok := pl.csiDriverForProvisioner(csiNode, storageClass.Provisioner)
+	if !ok {
+		return "", ""
+	}
+	return driverName, volumeHandle
+}
+
+// csiDriverForProvisioner resolves a StorageClass' provisioner to the CSI driver name
+// that should be charged for volumes it provisions: the provisioner itself, unless it
+// names an in-tree plugin being migrated to CSI, in which case the driver it's migrated
+// to is used (and ok is false if that migration isn't enabled for csiNode).
+func (pl *CSILimits) csiDriverForProvisioner(csiNode *storagev1.CSINode, provisioner string) (string, bool) {
+	if !pl.translator.IsMigratableIntreePluginByName(provisioner) {
+		return provisioner, true
+	}
+	if !isCSIMigrationOn(csiNode, provisioner) {
+		klog.V(5).InfoS("CSI Migration of provisioner is not enabled", "provisioner", provisioner)
+		return "", false
+	}
+	driverName, err := pl.translator.GetCSINameFromInTreeName(provisioner)
+	if err != nil {
+		klog.V(5).InfoS("Unable to look up driver name from provisioner name", "provisioner", provisioner, "err", err)
+		return "", false
+	}
+	return driverName, true
+}
+
+// pendingVolumeModificationTarget reports whether pvc is undergoing an in-flight
+// VolumeAttributesClass change or resize that is moving it onto a different
+// StorageClass, per pvcModifyVolumeTargetStorageClassAnnotationKey.
+func pendingVolumeModificationTarget(pvc *v1.PersistentVolumeClaim) (targetSCName string, requiresExpansion bool, ok bool) {
+	targetSCName = pvc.Annotations[pvcModifyVolumeTargetStorageClassAnnotationKey]
+	if targetSCName == "" {
+		return "", false, false
+	}
+	return targetSCName, pvc.Annotations[pvcModifyVolumeRequiresExpansionAnnotationKey] == "true", true
+}
+
+// resolveModificationTarget resolves the driver that a PVC undergoing an in-flight
+// modification (see pendingVolumeModificationTarget) should be charged against: the
+// provisioner of targetSCName. An empty driverName with a successful status means the
+// target StorageClass couldn't be resolved, so the caller should fall back to charging
+// the volume's current driver instead. If requiresExpansion is set and targetSCName
+// doesn't allow volume expansion, scheduling is refused outright, since the pending
+// modification could never complete on any node.
+func (pl *CSILimits) resolveModificationTarget(csiNode *storagev1.CSINode, pvc *v1.PersistentVolumeClaim, targetSCName string, requiresExpansion bool) (driverName string, status *framework.Status) {
+	targetSC, err := pl.scLister.Get(targetSCName)
+	if err != nil {
+		klog.V(5).InfoS("Could not get target StorageClass for in-flight volume modification", "PVC", klog.KObj(pvc), "targetStorageClass", targetSCName, "err", err)
+		return "", nil
+	}
+
+	if requiresExpansion && (targetSC.AllowVolumeExpansion == nil || !*targetSC.AllowVolumeExpansion) {
+		return "", framework.NewStatus(framework.UnschedulableAndUnresolvable,
+			fmt.Sprintf("%s: StorageClass %q", ErrReasonVolumeExpansionUnsupported, targetSCName))
+	}
+
+	driverName, ok := pl.csiDriverForProvisioner(csiNode, targetSC.Provisioner)
+	if !ok {
+		return "", nil
+	}
+	return driverName, nil
+}
+
+// ephemeralVolumeFromTemplate resolves the CSI driver, a synthesized volume handle, and the
+// StorageClass for a generic ephemeral volume whose auto-generated PVC (pvcName, in
+// namespace) hasn't been created yet, by reading the StorageClass straight off the volume's
+// embedded VolumeClaimTemplate instead of a materialized PVC. It delegates to
+// getCSIDriverInfoFromSC so the synthesized volume handle uses the exact same randomVolumeIDPrefix
+// scheme as an unbound regular PVC, and so repeated calls for the same pvcName agree on the handle.
+func (pl *CSILimits) ephemeralVolumeFromTemplate(csiNode *storagev1.CSINode, namespace, pvcName string, source *v1.EphemeralVolumeSource) (driverName, volumeHandle, scName string, ok bool) {
+	if source.VolumeClaimTemplate == nil {
+		return "", "", "", false
+	}
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: pvcName},
+		Spec:       source.VolumeClaimTemplate.Spec,
+	}
+	driverName, volumeHandle = pl.getCSIDriverInfoFromSC(csiNode, pvc)
+	if driverName == "" || volumeHandle == "" {
+		return "", "", "", false
+	}
+	if pvc.Spec.StorageClassName != nil {
+		scName = *pvc.Spec.StorageClassName
+	}
+	return driverName, volumeHandle, scName, true
+}
+
+// translateInTreeInlineVolumeToCSI resolves an inline (non-PVC) volume, such as an
+// AWSElasticBlockStore volume source, to its migrated CSI driver name and a synthesized
+// volume handle, if migration applies to it.
+func (pl *CSILimits) translateInTreeInlineVolumeToCSI(pod *v1.Pod, vol v1.Volume) (string, string) {
+	if !pl.translator.IsInlineMigratable(&vol) {
+		return "", ""
+	}
+	pv, err := pl.translator.TranslateInTreeInlineVolumeToCSI(&vol, pod.Namespace)
+	if err != nil || pv == nil || pv.Spec.PersistentVolumeSource.CSI == nil {
+		klog.V(5).InfoS("Unable to translate in-tree inline volume to CSI", "err", err)
+		return "", ""
+	}
+	csiSource := pv.Spec.PersistentVolumeSource.CSI
+	return csiSource.Driver, csiSource.VolumeHandle
+}
+
+// attachedVolumesFromVolumeAttachments returns the CSI driver for every VolumeAttachment
+// that is bound and attached to nodeName, keyed by volume handle. It is best-effort: if the
+// lister isn't wired up, or a VolumeAttachment's PV can't be resolved, that attachment is
+// simply skipped rather than failing the whole scheduling attempt.
+func (pl *CSILimits) attachedVolumesFromVolumeAttachments(nodeName string) map[string]string {
+	result := make(map[string]string)
+	if pl.volumeAttachmentLister == nil {
+		return result
+	}
+	attachments, err := pl.volumeAttachmentLister.List(labels.Everything())
+	if err != nil {
+		klog.V(5).InfoS("Unable to list VolumeAttachments", "err", err)
+		return result
+	}
+	for _, va := range attachments {
+		if va.Spec.NodeName != nodeName || !va.Status.Attached {
+			continue
+		}
+		pvName := va.Spec.Source.PersistentVolumeName
+		if pvName == nil {
+			continue
+		}
+		pv, err := pl.pvLister.Get(*pvName)
+		if err != nil {
+			continue
+		}
+		csiSource := pv.Spec.PersistentVolumeSource.CSI
+		if csiSource == nil {
+			continue
+		}
+		result[csiSource.VolumeHandle] = csiSource.Driver
+	}
+	return result
+}
+
+// driverVolumeLimit returns the max number of volumes driverName may have attached to node,
+// preferring the limit CSINode reports for the driver and falling back to the legacy
+// node.Status.Allocatable resource key used by in-tree plugins that predate CSINode.
+func (pl *CSILimits) driverVolumeLimit(node *v1.Node, csiNode *storagev1.CSINode, driverName string) (int64, bool) {
+	if csiNode != nil {
+		for _, d := range csiNode.Spec.Drivers {
+			if d.Name == driverName && d.Allocatable != nil && d.Allocatable.Count != nil {
+				return int64(*d.Allocatable.Count), true
+			}
+		}
+	}
+	if q, ok := node.Status.Allocatable[driverResourceName(driverName)]; ok {
+		return q.Value(), true
+	}
+	return 0, false
+}
+
+// storageClassVolumeLimit returns the max number of volumes provisioned from StorageClass
+// scName that may be attached to a node: csiNode's own per-class limit
+// (classVolumeLimitAnnotationKey), if node reports one, otherwise the StorageClass-wide
+// limit set by maxVolumesPerNodeAnnotationKey on the StorageClass itself. It reports
+// ok=false when neither applies (or neither annotation parses as an int64), in which
+// case no separate per-StorageClass cap applies and only the per-driver limit is
+// enforced.
+func (pl *CSILimits) storageClassVolumeLimit(csiNode *storagev1.CSINode, scName string) (int64, bool) {
+	if csiNode != nil {
+		if raw, ok := csiNode.Annotations[classVolumeLimitAnnotationKey(scName)]; ok {
+			limit, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				klog.V(5).InfoS("Could not parse per-StorageClass volume limit annotation on CSINode", "csiNode", csiNode.Name, "storageClass", scName, "value", raw, "err", err)
+			} else {
+				return limit, true
+			}
+		}
+	}
+
+	storageClass, err := pl.scLister.Get(scName)
+	if err != nil {
+		return 0, false
+	}
+	raw, ok := storageClass.Annotations[maxVolumesPerNodeAnnotationKey]
+	if !ok {
+		return 0, false
+	}
+	limit, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		klog.V(5).InfoS("Could not parse max-volumes-per-node annotation on StorageClass", "storageClass", scName, "value", raw, "err", err)
+		return 0, false
+	}
+	return limit, true
+}
+
+// driverResourceName returns the node.Status.Allocatable resource name under which
+// driverName's attach limit is reported, using the dedicated keys historically used
+// by the hand-written in-tree plugins and the generic CSI key for everything else.
+func driverResourceName(driverName string) v1.ResourceName {
+	switch driverName {
+	case ebsVolumeFilterType:
+		return v1.ResourceName(volumeutil.EBSVolumeLimitKey)
+	case gcePDVolumeFilterType:
+		return v1.ResourceName(volumeutil.GCEVolumeLimitKey)
+	case azureDiskVolumeFilterType:
+		return v1.ResourceName(volumeutil.AzureVolumeLimitKey)
+	case cinderVolumeFilterType:
+		return v1.ResourceName(volumeutil.CinderVolumeLimitKey)
+	default:
+		return v1.ResourceName(volumeutil.GetCSIAttachLimitKey(driverName))
+	}
+}
+
+// isCSIMigrationOn returns true if the given in-tree plugin is listed in the node's
+// MigratedPluginsAnnotationKey annotation.
+func isCSIMigrationOn(csiNode *storagev1.CSINode, pluginName string) bool {
+	if csiNode == nil || pluginName == "" {
+		return false
+	}
+	mpa := csiNode.Annotations[v1.MigratedPluginsAnnotationKey]
+	if mpa == "" {
+		return false
+	}
+	for _, plugin := range splitCommaSeparated(mpa) {
+		if plugin == pluginName {
+			return true
+		}
+	}
+	return false
+}
+
+func splitCommaSeparated(s string) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == ',' {
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+// Score invoked at the score extension point. It scores a node by how much spare
+// per-driver attach capacity it has left for the drivers the incoming pod's volumes
+// use: the score for each driver is (limit-attached-podRequest)/limit, aggregated
+// across drivers by taking the minimum (the most constrained driver determines how
+// much room the pod really has), then scaled onto [0, framework.MaxNodeScore]. A
+// driver the node reports no limit for contributes no pressure (treated as maximum
+// score for that driver). NormalizeScore below flips the ordering when the plugin
+// is configured for MostAllocated.
+func (pl *CSILimits) Score(ctx context.Context, _ *framework.CycleState, pod *v1.Pod, nodeName string) (int64, *framework.Status) {
+	nodeInfo, err := pl.handle.SnapshotSharedLister().NodeInfos().Get(nodeName)
+	if err != nil {
+		return 0, framework.AsStatus(fmt.Errorf("getting node %q from Snapshot: %w", nodeName, err))
+	}
+	return pl.score(nodeInfo, pod)
+}
+
+// score computes the spare-attach-capacity score for pod against nodeInfo. It is
+// split out from Score so it can be exercised directly in tests without having to
+// wire up a framework.Handle and a full snapshot.
+func (pl *CSILimits) score(nodeInfo *framework.NodeInfo, pod *v1.Pod) (int64, *framework.Status) {
+	node := nodeInfo.Node()
+	if node == nil {
+		return 0, framework.NewStatus(framework.Error, "node not found")
+	}
+
+	csiNode, _ := pl.csiNodeLister.Get(node.Name)
+
+	podVolumes, status := pl.filterAttachableVolumes(pod, csiNode)
+	if !status.IsSuccess() {
+		return 0, status
+	}
+	if len(podVolumes) == 0 {
+		return framework.MaxNodeScore, nil
+	}
+
+	podRequestByDriver := map[string]int64{}
+	for _, rv := range podVolumes {
+		podRequestByDriver[rv.driverName]++
+	}
+
+	attachedByDriver := map[string]int64{}
+	for _, existingPod := range nodeInfo.Pods {
+		existingVolumes, status := pl.filterAttachableVolumes(existingPod.Pod, csiNode)
+		if !status.IsSuccess() {
+			continue
+		}
+		for _, rv := range existingVolumes {
+			attachedByDriver[rv.driverName]++
+		}
+	}
+
+	minFraction := 1.0
+	for driverName, requested := range podRequestByDriver {
+		limit, ok := pl.driverVolumeLimit(node, csiNode, driverName)
+		if !ok || limit <= 0 {
+			// No reported limit for this driver: no pressure from it.
+			continue
+		}
+		fraction := float64(limit-attachedByDriver[driverName]-requested) / float64(limit)
+		if fraction < 0 {
+			fraction = 0
+		}
+		if fraction < minFraction {
+			minFraction = fraction
+		}
+	}
+
+	return int64(minFraction * float64(framework.MaxNodeScore)), nil
+}
+
+// ScoreExtensions returns the ScoreExtensions interface.
+func (pl *CSILimits) ScoreExtensions() framework.ScoreExtensions {
+	return pl
+}
+
+// NormalizeScore invoked after scoring all nodes. CSILimits' raw Score is already on
+// [0, framework.MaxNodeScore] favoring nodes with the most spare capacity
+// (LeastAllocated); when configured for MostAllocated the ordering is inverted here
+// so that nodes with the least spare capacity score highest instead.
+func (pl *CSILimits) NormalizeScore(ctx context.Context, _ *framework.CycleState, _ *v1.Pod, scores framework.NodeScoreList) *framework.Status {
+	if pl.scoringStrategy != MostAllocated {
+		return nil
+	}
+	for i := range scores {
+		scores[i].Score = framework.MaxNodeScore - scores[i].Score
+	}
+	return nil
+}
+
+// NewCSI initializes a new plugin and returns it.
+//
+// plArgs is accepted for consistency with the rest of the in-tree plugin factories,
+// but see the CSILimitsArgs doc comment: the scheduler's config decoder has no way to
+// produce a *CSILimitsArgs, so in a binary wired up from a KubeSchedulerConfiguration
+// this assertion never succeeds and scoringStrategy is always LeastAllocated. Passing
+// a *CSILimitsArgs only has an effect if the caller constructs the plugin directly.
+func NewCSI(_ context.Context, plArgs runtime.Object, handle framework.Handle) (framework.Plugin, error) {
+	informerFactory := handle.SharedInformerFactory()
+	pvLister := informerFactory.Core().V1().PersistentVolumes().Lister()
+	pvcLister := informerFactory.Core().V1().PersistentVolumeClaims().Lister()
+	scLister := informerFactory.Storage().V1().StorageClasses().Lister()
+	csiNodesLister := informerFactory.Storage().V1().CSINodes().Lister()
+	csiDriversLister := informerFactory.Storage().V1().CSIDrivers().Lister()
+	volumeAttachmentLister := informerFactory.Storage().V1().VolumeAttachments().Lister()
+
+	scoringStrategy := LeastAllocated
+	if args, ok := plArgs.(*CSILimitsArgs); ok && args.ScoringStrategy != "" {
+		scoringStrategy = args.ScoringStrategy
+	}
+
+	return &CSILimits{
+		csiNodeLister:          csiNodesLister,
+		csiDriverLister:        csiDriversLister,
+		volumeAttachmentLister: volumeAttachmentLister,
+		pvLister:               pvLister,
+		pvcLister:              pvcLister,
+		scLister:               scLister,
+		randomVolumeIDPrefix:   rand.String(32),
+		translator:             csitrans.New(),
+		scoringStrategy:        scoringStrategy,
+		handle:                 handle,
+	}, nil
+}
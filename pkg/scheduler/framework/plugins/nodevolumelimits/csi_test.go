@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -118,6 +119,18 @@ func TestCSILimits(t *testing.T) {
 	conflictingClaim := ephemeralClaim.DeepCopy()
 	conflictingClaim.OwnerReferences = nil
 
+	ephemeralVolumePodWithTemplate := st.MakePod().Name("tpl").Namespace("test").UID("tpl-uid").Volume(
+		v1.Volume{
+			Name: "xyz",
+			VolumeSource: v1.VolumeSource{
+				Ephemeral: &v1.EphemeralVolumeSource{
+					VolumeClaimTemplate: &v1.PersistentVolumeClaimTemplate{
+						Spec: v1.PersistentVolumeClaimSpec{StorageClassName: &scName},
+					},
+				},
+			},
+		}).Obj()
+
 	ephemeralTwoVolumePod := st.MakePod().Name("abc").Namespace("test").UID("12345II").Volume(v1.Volume{
 		Name: "x",
 		VolumeSource: v1.VolumeSource{
@@ -279,6 +292,7 @@ func TestCSILimits(t *testing.T) {
 	tests := []struct {
 		newPod              *v1.Pod
 		existingPods        []*v1.Pod
+		existingAttachments []storagev1.VolumeAttachment
 		extraClaims         []v1.PersistentVolumeClaim
 		filterName          string
 		maxVols             int
@@ -290,6 +304,58 @@ func TestCSILimits(t *testing.T) {
 		wantStatus          *framework.Status
 		wantPreFilterStatus *framework.Status
 	}{
+		{
+			newPod:       csiEBSOneVolPod,
+			existingPods: []*v1.Pod{runningPod},
+			existingAttachments: []storagev1.VolumeAttachment{
+				*makeVolumeAttachment("va-1", ebsCSIDriverName, "node-for-max-pd-test-1", "csi-ebs.csi.aws.com-1", true),
+				*makeVolumeAttachment("va-2", ebsCSIDriverName, "node-for-max-pd-test-1", "csi-ebs.csi.aws.com-2", true),
+			},
+			filterName:  "csi",
+			maxVols:     2,
+			driverNames: []string{ebsCSIDriverName},
+			test:        "real VolumeAttachments push the node over the limit even though the pod list alone would fit",
+			limitSource: "node",
+			wantStatus:  framework.NewStatus(framework.Unschedulable, ErrReasonMaxVolumeCountExceeded),
+		},
+		{
+			newPod:       csiEBSOneVolPod,
+			existingPods: []*v1.Pod{runningPod, csiEBSTwoVolPod},
+			existingAttachments: []storagev1.VolumeAttachment{
+				// Same volumes as the terminating/replacement pods above: must not be double-counted.
+				*makeVolumeAttachment("va-1", ebsCSIDriverName, "node-for-max-pd-test-1", "csi-ebs.csi.aws.com-1", true),
+				*makeVolumeAttachment("va-2", ebsCSIDriverName, "node-for-max-pd-test-1", "csi-ebs.csi.aws.com-2", true),
+			},
+			filterName:  "csi",
+			maxVols:     4,
+			driverNames: []string{ebsCSIDriverName},
+			test:        "VolumeAttachments for volumes already counted via nodeInfo.Pods are not double-counted",
+			limitSource: "node",
+		},
+		{
+			newPod:       csiEBSOneVolPod,
+			existingPods: []*v1.Pod{runningPod},
+			existingAttachments: []storagev1.VolumeAttachment{
+				*makeVolumeAttachment("va-1", ebsCSIDriverName, "some-other-node", "csi-ebs.csi.aws.com-1", true),
+			},
+			filterName:  "csi",
+			maxVols:     2,
+			driverNames: []string{ebsCSIDriverName},
+			test:        "VolumeAttachments on a different node are ignored",
+			limitSource: "node",
+		},
+		{
+			newPod:       csiEBSOneVolPod,
+			existingPods: []*v1.Pod{runningPod},
+			existingAttachments: []storagev1.VolumeAttachment{
+				*makeVolumeAttachment("va-1", ebsCSIDriverName, "node-for-max-pd-test-1", "csi-ebs.csi.aws.com-1", false),
+			},
+			filterName:  "csi",
+			maxVols:     2,
+			driverNames: []string{ebsCSIDriverName},
+			test:        "VolumeAttachments that are not yet Attached are ignored",
+			limitSource: "node",
+		},
 		{
 			newPod:       csiEBSOneVolPod,
 			existingPods: []*v1.Pod{runningPod, csiEBSTwoVolPod},
@@ -572,6 +638,25 @@ func TestCSILimits(t *testing.T) {
 			maxVols:          4,
 			test:             "persistent okay when node volume limit > pods ephemeral CSI volume + persistent volume",
 		},
+		{
+			newPod:           ephemeralVolumePodWithTemplate,
+			filterName:       "csi",
+			ephemeralEnabled: true,
+			driverNames:      []string{ebsCSIDriverName},
+			maxVols:          0,
+			limitSource:      "node",
+			test:             "ephemeral volume not yet materialized counts against the driver limit via its VolumeClaimTemplate StorageClass",
+			wantStatus:       framework.NewStatus(framework.Unschedulable, ErrReasonMaxVolumeCountExceeded),
+		},
+		{
+			newPod:           ephemeralVolumePodWithTemplate,
+			filterName:       "csi",
+			ephemeralEnabled: true,
+			driverNames:      []string{ebsCSIDriverName},
+			maxVols:          1,
+			limitSource:      "node",
+			test:             "ephemeral volume not yet materialized fits when the driver has room",
+		},
 		{
 			newPod:              onlyConfigmapAndSecretVolPod,
 			filterName:          "csi",
@@ -619,12 +704,13 @@ func TestCSILimits(t *testing.T) {
 			}
 			csiTranslator := csitrans.New()
 			p := &CSILimits{
-				csiNodeLister:        getFakeCSINodeLister(csiNode),
-				pvLister:             getFakeCSIPVLister(test.filterName, test.driverNames...),
-				pvcLister:            append(getFakeCSIPVCLister(test.filterName, scName, test.driverNames...), test.extraClaims...),
-				scLister:             getFakeCSIStorageClassLister(scName, test.driverNames[0]),
-				randomVolumeIDPrefix: rand.String(32),
-				translator:           csiTranslator,
+				csiNodeLister:          getFakeCSINodeLister(csiNode),
+				pvLister:               getFakeCSIPVLister(test.filterName, test.driverNames...),
+				pvcLister:              append(getFakeCSIPVCLister(test.filterName, scName, test.driverNames...), test.extraClaims...),
+				scLister:               getFakeCSIStorageClassLister(test.driverNames[0], scName),
+				volumeAttachmentLister: tf.VolumeAttachmentLister(test.existingAttachments),
+				randomVolumeIDPrefix:   rand.String(32),
+				translator:             csiTranslator,
 			}
 			_, ctx := ktesting.NewTestContext(t)
 			_, gotPreFilterStatus := p.PreFilter(ctx, nil, test.newPod)
@@ -641,6 +727,488 @@ func TestCSILimits(t *testing.T) {
 	}
 }
 
+func TestCSILimitsVolumeLifecycleMode(t *testing.T) {
+	persistentPod := st.MakePod().PVC("csi-ebs.csi.aws.com-0").Obj()
+	inTreeInlineVolPod := &v1.Pod{
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{
+					VolumeSource: v1.VolumeSource{
+						AWSElasticBlockStore: &v1.AWSElasticBlockStoreVolumeSource{
+							VolumeID: "aws-inline1",
+						},
+					},
+				},
+			},
+		},
+	}
+	ephemeralPod := st.MakePod().Name("abc").Namespace("test").UID("12345").Volume(
+		v1.Volume{
+			Name: "xyz",
+			VolumeSource: v1.VolumeSource{
+				Ephemeral: &v1.EphemeralVolumeSource{},
+			},
+		}).Obj()
+	controller := true
+	ephemeralClaim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: ephemeralPod.Namespace,
+			Name:      ephemeralPod.Name + "-xyz",
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "Pod", Name: ephemeralPod.Name, UID: ephemeralPod.UID, Controller: &controller},
+			},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{StorageClassName: &scName},
+	}
+
+	tests := []struct {
+		name        string
+		pod         *v1.Pod
+		extraClaims []v1.PersistentVolumeClaim
+		modes       []storagev1.VolumeLifecycleMode
+		wantStatus  *framework.Status
+	}{
+		{
+			name:  "no CSIDriver registered: always allowed",
+			pod:   persistentPod,
+			modes: nil,
+		},
+		{
+			name:  "persistent volume, driver supports Persistent",
+			pod:   persistentPod,
+			modes: []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecyclePersistent},
+		},
+		{
+			name:       "persistent volume, driver only supports Ephemeral",
+			pod:        persistentPod,
+			modes:      []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecycleEphemeral},
+			wantStatus: framework.NewStatus(framework.UnschedulableAndUnresolvable, fmt.Sprintf("%s: driver %q does not support volume lifecycle mode %q", ErrReasonVolumeLifecycleUnsupported, ebsCSIDriverName, storagev1.VolumeLifecyclePersistent)),
+		},
+		{
+			name:        "ephemeral volume, driver supports Ephemeral",
+			pod:         ephemeralPod,
+			extraClaims: []v1.PersistentVolumeClaim{*ephemeralClaim},
+			modes:       []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecycleEphemeral},
+		},
+		{
+			name:        "ephemeral volume, driver only supports Persistent",
+			pod:         ephemeralPod,
+			extraClaims: []v1.PersistentVolumeClaim{*ephemeralClaim},
+			modes:       []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecyclePersistent},
+			wantStatus:  framework.NewStatus(framework.UnschedulableAndUnresolvable, fmt.Sprintf("%s: driver %q does not support volume lifecycle mode %q", ErrReasonVolumeLifecycleUnsupported, ebsCSIDriverName, storagev1.VolumeLifecycleEphemeral)),
+		},
+		{
+			// Migrated in-tree inline volumes (e.g. AWSElasticBlockStore) are attached as
+			// ordinary persistent CSI attachments, not CSI ephemeral inline volumes, so the
+			// driver only needs to support Persistent.
+			name:  "in-tree inline volume, migrated driver supports Persistent",
+			pod:   inTreeInlineVolPod,
+			modes: []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecyclePersistent},
+		},
+		{
+			name:       "in-tree inline volume, migrated driver only supports Ephemeral",
+			pod:        inTreeInlineVolPod,
+			modes:      []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecycleEphemeral},
+			wantStatus: framework.NewStatus(framework.UnschedulableAndUnresolvable, fmt.Sprintf("%s: driver %q does not support volume lifecycle mode %q", ErrReasonVolumeLifecycleUnsupported, ebsCSIDriverName, storagev1.VolumeLifecyclePersistent)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &CSILimits{
+				csiNodeLister:        getFakeCSINodeLister(nil),
+				csiDriverLister:      getFakeCSIDriverLister(ebsCSIDriverName, test.modes...),
+				pvLister:             getFakeCSIPVLister("csi", ebsCSIDriverName),
+				pvcLister:            append(getFakeCSIPVCLister("csi", scName, ebsCSIDriverName), test.extraClaims...),
+				scLister:             getFakeCSIStorageClassLister(ebsCSIDriverName, scName),
+				randomVolumeIDPrefix: rand.String(32),
+				translator:           csitrans.New(),
+			}
+			_, status := p.filterAttachableVolumes(test.pod, nil)
+			if diff := cmp.Diff(test.wantStatus, status); diff != "" {
+				t.Errorf("status does not match (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestCSILimitsStorageClassVolumeLimit(t *testing.T) {
+	pod := st.MakePod().PVC("sc-limit-pvc").Obj()
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "sc-limit-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: ebsCSIDriverName, VolumeHandle: "sc-limit-pv"},
+			},
+		},
+	}
+	pvc := v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "sc-limit-pvc"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "sc-limit-pv", StorageClassName: &scName},
+	}
+
+	tests := []struct {
+		name          string
+		scAnnotation  string
+		driverMaxVols int64
+		wantStatus    *framework.Status
+	}{
+		{
+			name:          "driver limit has room, but the per-StorageClass annotation is already exhausted",
+			scAnnotation:  "0",
+			driverMaxVols: 10,
+			wantStatus:    framework.NewStatus(framework.Unschedulable, fmt.Sprintf("%s: StorageClass %q exceeds its max-volumes-per-node cap", ErrReasonMaxVolumeCountExceeded, scName)),
+		},
+		{
+			name:          "per-StorageClass annotation has plenty of room, but the driver limit is exhausted",
+			scAnnotation:  "10",
+			driverMaxVols: 0,
+			wantStatus:    framework.NewStatus(framework.Unschedulable, ErrReasonMaxVolumeCountExceeded),
+		},
+		{
+			name:          "both the driver limit and the per-StorageClass annotation have room",
+			scAnnotation:  "10",
+			driverMaxVols: 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node, csiNode := getNodeWithPodAndVolumeLimits("node", nil, test.driverMaxVols, ebsCSIDriverName)
+			p := &CSILimits{
+				csiNodeLister: getFakeCSINodeLister(csiNode),
+				pvLister:      tf.PersistentVolumeLister{*pv},
+				pvcLister:     tf.PersistentVolumeClaimLister{pvc},
+				scLister: tf.StorageClassLister{
+					{
+						ObjectMeta:  metav1.ObjectMeta{Name: scName, Annotations: map[string]string{maxVolumesPerNodeAnnotationKey: test.scAnnotation}},
+						Provisioner: ebsCSIDriverName,
+					},
+				},
+				randomVolumeIDPrefix: rand.String(32),
+				translator:           csitrans.New(),
+			}
+			_, ctx := ktesting.NewTestContext(t)
+			gotStatus := p.Filter(ctx, nil, pod, node)
+			if diff := cmp.Diff(test.wantStatus, gotStatus); diff != "" {
+				t.Errorf("Filter status does not match (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestCSILimitsPerNodeStorageClassVolumeLimit(t *testing.T) {
+	fastSC := "fast-sc"
+	slowSC := "slow-sc"
+
+	newPod := st.MakePod().PVC("new-pvc").Obj()
+	newPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "new-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: ebsCSIDriverName, VolumeHandle: "new-pv"},
+			},
+		},
+	}
+	newPVC := v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "new-pvc"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "new-pv", StorageClassName: &fastSC},
+	}
+
+	existingPod := st.MakePod().Name("existing").PVC("existing-pvc").Obj()
+	existingPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: ebsCSIDriverName, VolumeHandle: "existing-pv"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name              string
+		existingPodSCName string
+		wantStatus        *framework.Status
+	}{
+		{
+			name:              "the slow class is already at its own cap, but that doesn't count against the unrelated fast class",
+			existingPodSCName: slowSC,
+		},
+		{
+			name:              "the fast class is already at its own cap: a new volume from the same class is refused",
+			existingPodSCName: fastSC,
+			wantStatus:        framework.NewStatus(framework.Unschedulable, fmt.Sprintf("%s: StorageClass %q exceeds its max-volumes-per-node cap", ErrReasonMaxVolumeCountExceeded, fastSC)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			existingPVC := v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "existing-pvc"},
+				Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "existing-pv", StorageClassName: &test.existingPodSCName},
+			}
+
+			// Driver limit of 10 has plenty of room for both volumes; only the
+			// per-class caps set on the CSINode below are meant to bind.
+			node, csiNode := getNodeWithPodAndVolumeLimits("both", []*v1.Pod{existingPod}, 10, ebsCSIDriverName)
+			p := &CSILimits{
+				csiNodeLister:        getFakeCSINodeLister(csiNode, map[string]int64{fastSC: 1, slowSC: 1}),
+				pvLister:             tf.PersistentVolumeLister{*newPV, *existingPV},
+				pvcLister:            tf.PersistentVolumeClaimLister{newPVC, existingPVC},
+				scLister:             getFakeCSIStorageClassLister(ebsCSIDriverName, fastSC, slowSC),
+				randomVolumeIDPrefix: rand.String(32),
+				translator:           csitrans.New(),
+			}
+			_, ctx := ktesting.NewTestContext(t)
+			gotStatus := p.Filter(ctx, nil, newPod, node)
+			if diff := cmp.Diff(test.wantStatus, gotStatus); diff != "" {
+				t.Errorf("Filter status does not match (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestCSILimitsPendingVolumeModification(t *testing.T) {
+	pod := st.MakePod().PVC("modifying-pvc").Obj()
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "modifying-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: ebsCSIDriverName, VolumeHandle: "modifying-pv"},
+			},
+		},
+	}
+	targetSCName := "target-sc"
+
+	tests := []struct {
+		name                  string
+		requiresExpansion     bool
+		targetAllowsExpansion *bool
+		driverNames           []string
+		driverMaxVols         int64
+		wantStatus            *framework.Status
+	}{
+		{
+			name:          "class transition alone charges the volume to the target driver",
+			driverNames:   []string{gceCSIDriverName},
+			driverMaxVols: 0,
+			wantStatus:    framework.NewStatus(framework.Unschedulable, ErrReasonMaxVolumeCountExceeded),
+		},
+		{
+			name:                  "expansion required and the target class allows it: counted against the target driver",
+			requiresExpansion:     true,
+			targetAllowsExpansion: pointer.Bool(true),
+			driverNames:           []string{gceCSIDriverName},
+			driverMaxVols:         1,
+		},
+		{
+			name:                  "expansion required but the target class doesn't allow it: refused outright",
+			requiresExpansion:     true,
+			targetAllowsExpansion: pointer.Bool(false),
+			driverNames:           []string{gceCSIDriverName},
+			driverMaxVols:         1,
+			wantStatus:            framework.NewStatus(framework.UnschedulableAndUnresolvable, fmt.Sprintf("%s: StorageClass %q", ErrReasonVolumeExpansionUnsupported, targetSCName)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pvc := v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "modifying-pvc",
+					Annotations: map[string]string{
+						pvcModifyVolumeTargetStorageClassAnnotationKey: targetSCName,
+					},
+				},
+				Spec: v1.PersistentVolumeClaimSpec{VolumeName: "modifying-pv", StorageClassName: &scName},
+			}
+			if test.requiresExpansion {
+				pvc.Annotations[pvcModifyVolumeRequiresExpansionAnnotationKey] = "true"
+			}
+
+			node, csiNode := getNodeWithPodAndVolumeLimits("node", nil, test.driverMaxVols, test.driverNames...)
+			p := &CSILimits{
+				csiNodeLister: getFakeCSINodeLister(csiNode),
+				pvLister:      tf.PersistentVolumeLister{*pv},
+				pvcLister:     tf.PersistentVolumeClaimLister{pvc},
+				scLister: tf.StorageClassLister{
+					{ObjectMeta: metav1.ObjectMeta{Name: scName}, Provisioner: ebsCSIDriverName},
+					{
+						ObjectMeta:           metav1.ObjectMeta{Name: targetSCName},
+						Provisioner:          gceCSIDriverName,
+						AllowVolumeExpansion: test.targetAllowsExpansion,
+					},
+				},
+				randomVolumeIDPrefix: rand.String(32),
+				translator:           csitrans.New(),
+			}
+			_, ctx := ktesting.NewTestContext(t)
+			gotStatus := p.Filter(ctx, nil, pod, node)
+			if diff := cmp.Diff(test.wantStatus, gotStatus); diff != "" {
+				t.Errorf("Filter status does not match (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+// TestCSILimitsExistingPodFailureNotPropagated verifies that an already-scheduled
+// neighbor pod whose volumes fail to resolve (e.g. an in-flight modification stuck on a
+// StorageClass that doesn't support the expansion it requires) only costs that neighbor
+// its own counting, not the incoming pod's chance to schedule at all: Filter must not
+// return the neighbor's failure status for a pod that doesn't even share its volumes.
+func TestCSILimitsExistingPodFailureNotPropagated(t *testing.T) {
+	targetSCName := "target-sc"
+	modifyingPVC := v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "modifying-pvc",
+			Annotations: map[string]string{
+				pvcModifyVolumeTargetStorageClassAnnotationKey: targetSCName,
+				pvcModifyVolumeRequiresExpansionAnnotationKey:  "true",
+			},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{VolumeName: "modifying-pv", StorageClassName: &scName},
+	}
+	modifyingPV := v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "modifying-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: ebsCSIDriverName, VolumeHandle: "modifying-pv"},
+			},
+		},
+	}
+	existingPod := st.MakePod().Name("neighbor").PVC("modifying-pvc").Obj()
+
+	healthyPVC := v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "healthy-pvc"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "healthy-pv", StorageClassName: &scName},
+	}
+	healthyPV := v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "healthy-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: ebsCSIDriverName, VolumeHandle: "healthy-pv"},
+			},
+		},
+	}
+	newPod := st.MakePod().PVC("healthy-pvc").Obj()
+
+	node, csiNode := getNodeWithPodAndVolumeLimits("node", []*v1.Pod{existingPod}, 10, ebsCSIDriverName)
+	p := &CSILimits{
+		csiNodeLister: getFakeCSINodeLister(csiNode),
+		pvLister:      tf.PersistentVolumeLister{modifyingPV, healthyPV},
+		pvcLister:     tf.PersistentVolumeClaimLister{modifyingPVC, healthyPVC},
+		scLister: tf.StorageClassLister{
+			{ObjectMeta: metav1.ObjectMeta{Name: scName}, Provisioner: ebsCSIDriverName},
+			{
+				ObjectMeta:           metav1.ObjectMeta{Name: targetSCName},
+				Provisioner:          gceCSIDriverName,
+				AllowVolumeExpansion: pointer.Bool(false),
+			},
+		},
+		randomVolumeIDPrefix: rand.String(32),
+		translator:           csitrans.New(),
+	}
+	_, ctx := ktesting.NewTestContext(t)
+	gotStatus := p.Filter(ctx, nil, newPod, node)
+	if gotStatus != nil {
+		t.Errorf("Filter status does not match (-want, +got): want nil, got %v", gotStatus)
+	}
+}
+
+func getFakeCSIDriverLister(driverName string, modes ...storagev1.VolumeLifecycleMode) tf.CSIDriverLister {
+	if len(modes) == 0 {
+		return tf.CSIDriverLister{}
+	}
+	return tf.CSIDriverLister{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: driverName},
+			Spec:       storagev1.CSIDriverSpec{VolumeLifecycleModes: modes},
+		},
+	}
+}
+
+func TestCSILimitsScore(t *testing.T) {
+	csiEBSOneVolPod := st.MakePod().PVC("csi-ebs.csi.aws.com-0").Obj()
+
+	tests := []struct {
+		name            string
+		pod             *v1.Pod
+		nodeAttached    int
+		maxVols         int
+		scoringStrategy ScoringStrategyType
+		wantScore       int64
+	}{
+		{
+			name:            "least allocated: node with spare capacity scores proportionally",
+			pod:             csiEBSOneVolPod,
+			nodeAttached:    0,
+			maxVols:         4,
+			scoringStrategy: LeastAllocated,
+			wantScore:       75,
+		},
+		{
+			name:            "least allocated: node near its limit scores low",
+			pod:             csiEBSOneVolPod,
+			nodeAttached:    3,
+			maxVols:         4,
+			scoringStrategy: LeastAllocated,
+			wantScore:       0,
+		},
+		{
+			name:            "most allocated: node near its limit scores high",
+			pod:             csiEBSOneVolPod,
+			nodeAttached:    3,
+			maxVols:         4,
+			scoringStrategy: MostAllocated,
+			wantScore:       framework.MaxNodeScore,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			existingPods := make([]*v1.Pod, 0, test.nodeAttached)
+			for i := 0; i < test.nodeAttached; i++ {
+				existingPods = append(existingPods, st.MakePod().PVC(fmt.Sprintf("csi-ebs.csi.aws.com-%d", i)).Obj())
+			}
+			node, csiNode := getNodeWithPodAndVolumeLimits("csinode", existingPods, int64(test.maxVols), ebsCSIDriverName)
+
+			p := &CSILimits{
+				csiNodeLister:        getFakeCSINodeLister(csiNode),
+				pvLister:             getFakeCSIPVLister("csi", ebsCSIDriverName),
+				pvcLister:            getFakeCSIPVCLister("csi", scName, ebsCSIDriverName),
+				scLister:             getFakeCSIStorageClassLister(ebsCSIDriverName, scName),
+				randomVolumeIDPrefix: rand.String(32),
+				translator:           csitrans.New(),
+				scoringStrategy:      test.scoringStrategy,
+			}
+
+			rawScore, status := p.score(node, test.pod)
+			if status != nil && !status.IsSuccess() {
+				t.Fatalf("unexpected score status: %v", status)
+			}
+			scores := framework.NodeScoreList{{Name: node.Node().Name, Score: rawScore}}
+			if status := p.NormalizeScore(nil, nil, test.pod, scores); status != nil && !status.IsSuccess() {
+				t.Fatalf("unexpected normalize status: %v", status)
+			}
+			if scores[0].Score != test.wantScore {
+				t.Errorf("Score() = %d, want %d", scores[0].Score, test.wantScore)
+			}
+		})
+	}
+}
+
+func makeVolumeAttachment(name, attacher, nodeName, pvName string, attached bool) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: attacher,
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+	}
+}
+
 func getFakeCSIPVLister(volumeName string, driverNames ...string) tf.PersistentVolumeLister {
 	pvLister := tf.PersistentVolumeLister{}
 	for _, driver := range driverNames {
@@ -729,23 +1297,48 @@ func enableMigrationOnNode(csiNode *storagev1.CSINode, pluginName string) {
 	csiNode.Annotations = nodeInfoAnnotations
 }
 
-func getFakeCSIStorageClassLister(scName, provisionerName string) tf.StorageClassLister {
-	return tf.StorageClassLister{
-		{
+// getFakeCSIStorageClassLister returns a StorageClassLister seeded with one
+// StorageClass per name in scNames, all provisioned by provisionerName, so tests can
+// exercise multiple classes that share a driver.
+func getFakeCSIStorageClassLister(provisionerName string, scNames ...string) tf.StorageClassLister {
+	lister := tf.StorageClassLister{}
+	for _, scName := range scNames {
+		lister = append(lister, storagev1.StorageClass{
 			ObjectMeta:  metav1.ObjectMeta{Name: scName},
 			Provisioner: provisionerName,
-		},
+		})
 	}
+	return lister
 }
 
-func getFakeCSINodeLister(csiNode *storagev1.CSINode) tf.CSINodeLister {
+// getFakeCSINodeLister returns a CSINodeLister containing csiNode, if non-nil, with
+// classLimits (if given) set as per-StorageClass volume limit annotations
+// (classVolumeLimitAnnotationKey) on it, so tests can seed independent per-class caps
+// alongside the driver limits already on csiNode.Spec.Drivers.
+func getFakeCSINodeLister(csiNode *storagev1.CSINode, classLimits ...map[string]int64) tf.CSINodeLister {
 	csiNodeLister := tf.CSINodeLister{}
-	if csiNode != nil {
-		csiNodeLister = append(csiNodeLister, *csiNode.DeepCopy())
+	if csiNode == nil {
+		return csiNodeLister
+	}
+	csiNode = csiNode.DeepCopy()
+	for _, limits := range classLimits {
+		for scName, limit := range limits {
+			setClassVolumeLimitOnCSINode(csiNode, scName, limit)
+		}
 	}
+	csiNodeLister = append(csiNodeLister, *csiNode)
 	return csiNodeLister
 }
 
+// setClassVolumeLimitOnCSINode sets csiNode's classVolumeLimitAnnotationKey annotation
+// for scName to limit, the same way enableMigrationOnNode seeds migration annotations.
+func setClassVolumeLimitOnCSINode(csiNode *storagev1.CSINode, scName string, limit int64) {
+	if csiNode.Annotations == nil {
+		csiNode.Annotations = map[string]string{}
+	}
+	csiNode.Annotations[classVolumeLimitAnnotationKey(scName)] = strconv.FormatInt(limit, 10)
+}
+
 func getNodeWithPodAndVolumeLimits(limitSource string, pods []*v1.Pod, limit int64, driverNames ...string) (*framework.NodeInfo, *storagev1.CSINode) {
 	nodeInfo := framework.NewNodeInfo(pods...)
 	node := &v1.Node{
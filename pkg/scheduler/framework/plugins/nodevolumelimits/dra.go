@@ -0,0 +1,237 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodevolumelimits
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	resourcelisters "k8s.io/client-go/listers/resource/v1beta1"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/features"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+)
+
+// DRAName is the name of the plugin used in the plugin registry and configurations.
+const DRAName = "DRALimits"
+
+// ErrReasonDRADeviceCapacityExceeded is used to create predicate failure message when
+// a DRA driver's advertised per-node device capacity would be exceeded.
+const ErrReasonDRADeviceCapacityExceeded = "node(s) exceed DRA driver device capacity"
+
+// DRALimits is a filter plugin that checks a node's advertised dynamic resource
+// allocation (DRA) device capacity, published per driver via ResourceSlice objects,
+// against the devices a pod's ResourceClaims would add on top of what's already
+// allocated to pods on that node. It plays the same role for DRA devices that
+// CSILimits plays for CSI volume attach limits, and mirrors its structure.
+type DRALimits struct {
+	resourceClaimLister resourcelisters.ResourceClaimLister
+	resourceSliceLister resourcelisters.ResourceSliceLister
+
+	enabled bool
+}
+
+var (
+	_ framework.PreFilterPlugin   = &DRALimits{}
+	_ framework.FilterPlugin      = &DRALimits{}
+	_ framework.EnqueueExtensions = &DRALimits{}
+)
+
+// Name returns name of the plugin. It is used in logs, etc.
+func (pl *DRALimits) Name() string {
+	return DRAName
+}
+
+// EventsToRegister returns the possible events that may make a Pod
+// failed by this plugin schedulable.
+func (pl *DRALimits) EventsToRegister() []framework.ClusterEventWithHint {
+	return []framework.ClusterEventWithHint{
+		{Event: framework.ClusterEvent{Resource: framework.ResourceSlice, ActionType: framework.Add | framework.Update}},
+		{Event: framework.ClusterEvent{Resource: framework.Pod, ActionType: framework.Delete}},
+		{Event: framework.ClusterEvent{Resource: framework.ResourceClaim, ActionType: framework.Add | framework.Update}},
+	}
+}
+
+// PreFilter invoked at the prefilter extension point.
+//
+// If the DynamicResourceAllocation feature gate is off, or the pod doesn't reference
+// any ResourceClaims, Filter is skipped for it entirely.
+func (pl *DRALimits) PreFilter(ctx context.Context, _ *framework.CycleState, pod *v1.Pod) (*framework.PreFilterResult, *framework.Status) {
+	if !pl.enabled || len(pod.Spec.ResourceClaims) == 0 {
+		return nil, framework.NewStatus(framework.Skip)
+	}
+	return nil, nil
+}
+
+// PreFilterExtensions returns prefilter extensions, pod add and remove.
+func (pl *DRALimits) PreFilterExtensions() framework.PreFilterExtensions {
+	return nil
+}
+
+// Filter invoked at the filter extension point.
+func (pl *DRALimits) Filter(ctx context.Context, _ *framework.CycleState, pod *v1.Pod, nodeInfo *framework.NodeInfo) *framework.Status {
+	node := nodeInfo.Node()
+	if node == nil {
+		return framework.NewStatus(framework.Error, "node not found")
+	}
+
+	newClaims, status := pl.resolvePodClaims(pod)
+	if !status.IsSuccess() {
+		return status
+	}
+	if len(newClaims) == 0 {
+		return nil
+	}
+
+	allocatedClaims := make(map[string]resolvedClaim)
+	for _, existingPod := range nodeInfo.Pods {
+		existingClaims, status := pl.resolvePodClaims(existingPod.Pod)
+		if !status.IsSuccess() {
+			return status
+		}
+		for claimKey, rc := range existingClaims {
+			allocatedClaims[claimKey] = rc
+		}
+	}
+
+	allocatedCount := map[string]int{}
+	for claimKey, rc := range allocatedClaims {
+		if _, ok := newClaims[claimKey]; ok {
+			// Don't count a claim already used by the incoming pod more than once.
+			continue
+		}
+		allocatedCount[rc.driverName] += rc.deviceCount
+	}
+
+	newCount := map[string]int{}
+	for _, rc := range newClaims {
+		newCount[rc.driverName] += rc.deviceCount
+	}
+
+	for driverName, count := range newCount {
+		capacity, ok := pl.driverDeviceCapacity(node.Name, driverName)
+		if !ok {
+			continue
+		}
+		if int64(count+allocatedCount[driverName]) > capacity {
+			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("%s: driver %q", ErrReasonDRADeviceCapacityExceeded, driverName))
+		}
+	}
+
+	return nil
+}
+
+// resolvedClaim is what one of a pod's ResourceClaims resolves to for device-capacity
+// counting purposes: the driver that allocated it, and how many devices from that
+// driver it holds.
+type resolvedClaim struct {
+	driverName  string
+	deviceCount int
+}
+
+// resolvePodClaims resolves every allocated ResourceClaim referenced by pod to the
+// driver(s) that backed its allocation and how many devices each contributed,
+// returning a map keyed by a name that uniquely identifies the (claim, driver) pair so
+// a claim referenced by multiple containers isn't double-counted; pod.Spec.ResourceClaims
+// already lists each claim once regardless of how many containers reference it, so
+// simply iterating it is enough to dedupe within a single pod.
+func (pl *DRALimits) resolvePodClaims(pod *v1.Pod) (map[string]resolvedClaim, *framework.Status) {
+	result := make(map[string]resolvedClaim)
+	for _, podClaim := range pod.Spec.ResourceClaims {
+		claimName := resourceClaimName(pod, podClaim)
+		if claimName == "" {
+			// A claim from a ResourceClaimTemplate that hasn't been instantiated yet: there
+			// is nothing allocated, so nothing to count against any driver's capacity.
+			continue
+		}
+
+		claim, err := pl.resourceClaimLister.ResourceClaims(pod.Namespace).Get(claimName)
+		if err != nil {
+			klog.V(5).InfoS("Could not get ResourceClaim, not counting it", "pod", klog.KObj(pod), "resourceClaim", claimName)
+			continue
+		}
+		if claim.Status.Allocation == nil {
+			continue
+		}
+
+		byDriver := map[string]int{}
+		for _, result := range claim.Status.Allocation.Devices.Results {
+			byDriver[result.Driver]++
+		}
+		for driverName, deviceCount := range byDriver {
+			claimKey := fmt.Sprintf("%s/%s#%s", pod.Namespace, claimName, driverName)
+			result[claimKey] = resolvedClaim{driverName: driverName, deviceCount: deviceCount}
+		}
+	}
+	return result, nil
+}
+
+// resourceClaimName returns the name of the ResourceClaim backing podClaim: its
+// directly-named claim, or, for a claim generated from a ResourceClaimTemplate, the
+// generated name recorded in the pod's status once the claim controller has created it
+// (empty if it hasn't yet).
+func resourceClaimName(pod *v1.Pod, podClaim v1.PodResourceClaim) string {
+	if podClaim.ResourceClaimName != nil {
+		return *podClaim.ResourceClaimName
+	}
+	for _, status := range pod.Status.ResourceClaimStatuses {
+		if status.Name == podClaim.Name {
+			if status.ResourceClaimName != nil {
+				return *status.ResourceClaimName
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// driverDeviceCapacity returns the total number of devices driverName has published for
+// nodeName across all of its ResourceSlices, analogous to the per-driver
+// CSINode.Spec.Drivers[].Allocatable.Count consulted by CSILimits. ok is false if the
+// driver has published no ResourceSlices for the node, in which case no capacity is
+// enforced for it.
+func (pl *DRALimits) driverDeviceCapacity(nodeName, driverName string) (int64, bool) {
+	slices, err := pl.resourceSliceLister.List(labels.Everything())
+	if err != nil {
+		klog.V(5).InfoS("Unable to list ResourceSlices", "err", err)
+		return 0, false
+	}
+	var capacity int64
+	found := false
+	for _, slice := range slices {
+		if slice.Spec.Driver != driverName || slice.Spec.NodeName != nodeName {
+			continue
+		}
+		capacity += int64(len(slice.Spec.Devices))
+		found = true
+	}
+	return capacity, found
+}
+
+// NewDRA initializes a new plugin and returns it.
+func NewDRA(_ context.Context, plArgs runtime.Object, handle framework.Handle) (framework.Plugin, error) {
+	informerFactory := handle.SharedInformerFactory()
+	return &DRALimits{
+		resourceClaimLister: informerFactory.Resource().V1beta1().ResourceClaims().Lister(),
+		resourceSliceLister: informerFactory.Resource().V1beta1().ResourceSlices().Lister(),
+		enabled:             utilfeature.DefaultFeatureGate.Enabled(features.DynamicResourceAllocation),
+	}, nil
+}
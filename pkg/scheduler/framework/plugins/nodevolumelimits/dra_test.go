@@ -0,0 +1,274 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodevolumelimits
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	resourcelisters "k8s.io/client-go/listers/resource/v1beta1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"k8s.io/kubernetes/test/utils/ktesting"
+	"k8s.io/utils/pointer"
+)
+
+const draTestNodeName = "node-for-dra-test"
+
+func TestDRALimitsFilter(t *testing.T) {
+	gpuDriver := "gpu.example.com"
+
+	podWithClaim := func(podName, claimName string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: "test"},
+			Spec: v1.PodSpec{
+				ResourceClaims: []v1.PodResourceClaim{
+					{Name: "gpu", ResourceClaimName: &claimName},
+				},
+			},
+		}
+	}
+	podWithTemplateClaim := func(podName, templateRequestName string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: "test"},
+			Spec: v1.PodSpec{
+				ResourceClaims: []v1.PodResourceClaim{
+					{Name: templateRequestName, ResourceClaimTemplateName: pointer.String("gpu-template")},
+				},
+			},
+		}
+	}
+
+	newPod := podWithClaim("new-pod", "new-pod-gpu")
+	allocatedClaim := func(name string, deviceCount int) *resourceapi.ResourceClaim {
+		var results []resourceapi.DeviceRequestAllocationResult
+		for i := 0; i < deviceCount; i++ {
+			results = append(results, resourceapi.DeviceRequestAllocationResult{
+				Driver: gpuDriver,
+				Pool:   "pool-0",
+				Device: fmt.Sprintf("dev-%d", i),
+			})
+		}
+		return &resourceapi.ResourceClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"},
+			Status: resourceapi.ResourceClaimStatus{
+				Allocation: &resourceapi.AllocationResult{
+					Devices: resourceapi.DeviceAllocationResult{Results: results},
+				},
+			},
+		}
+	}
+
+	existingPod := podWithClaim("existing-pod", "existing-pod-gpu")
+
+	tests := []struct {
+		name         string
+		newPod       *v1.Pod
+		existingPods []*v1.Pod
+		claims       []*resourceapi.ResourceClaim
+		maxDevices   int64
+		limitSource  string
+		wantStatus   *framework.Status
+	}{
+		{
+			name:        "fits when driver has spare device capacity",
+			newPod:      newPod,
+			claims:      []*resourceapi.ResourceClaim{allocatedClaim("new-pod-gpu", 1)},
+			maxDevices:  2,
+			limitSource: "node",
+		},
+		{
+			name:        "exceeds the driver's advertised device capacity",
+			newPod:      newPod,
+			claims:      []*resourceapi.ResourceClaim{allocatedClaim("new-pod-gpu", 1)},
+			maxDevices:  0,
+			limitSource: "node",
+			wantStatus:  framework.NewStatus(framework.Unschedulable, fmt.Sprintf("%s: driver %q", ErrReasonDRADeviceCapacityExceeded, gpuDriver)),
+		},
+		{
+			name:         "devices already allocated to a pod on the node count against the same budget",
+			newPod:       newPod,
+			existingPods: []*v1.Pod{existingPod},
+			claims: []*resourceapi.ResourceClaim{
+				allocatedClaim("new-pod-gpu", 1),
+				allocatedClaim("existing-pod-gpu", 1),
+			},
+			maxDevices:  1,
+			limitSource: "node",
+			wantStatus:  framework.NewStatus(framework.Unschedulable, fmt.Sprintf("%s: driver %q", ErrReasonDRADeviceCapacityExceeded, gpuDriver)),
+		},
+		{
+			name:        "claim not created yet is not counted against any driver",
+			newPod:      newPod,
+			claims:      nil,
+			maxDevices:  0,
+			limitSource: "node",
+		},
+		{
+			name:        "claim generated from a template that hasn't been instantiated yet is not counted",
+			newPod:      podWithTemplateClaim("tpl-pod", "gpu"),
+			maxDevices:  0,
+			limitSource: "node",
+		},
+		{
+			name:        "no ResourceSlice published for the driver: no capacity enforced",
+			newPod:      newPod,
+			claims:      []*resourceapi.ResourceClaim{allocatedClaim("new-pod-gpu", 5)},
+			limitSource: "none",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodeInfo, slices := getNodeWithPodAndResourceClaims(test.limitSource, test.existingPods, test.maxDevices, gpuDriver)
+			p := &DRALimits{
+				resourceClaimLister: getFakeResourceClaimLister(test.claims...),
+				resourceSliceLister: getFakeResourceSliceLister(slices...),
+				enabled:             true,
+			}
+			_, ctx := ktesting.NewTestContext(t)
+			gotStatus := p.Filter(ctx, nil, test.newPod, nodeInfo)
+			if !reflect.DeepEqual(gotStatus, test.wantStatus) {
+				t.Errorf("Filter status does not match: %v, want: %v", gotStatus, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDRALimitsPreFilter(t *testing.T) {
+	podWithNoClaims := &v1.Pod{}
+	podWithClaim := &v1.Pod{
+		Spec: v1.PodSpec{
+			ResourceClaims: []v1.PodResourceClaim{{Name: "gpu", ResourceClaimName: pointer.String("gpu-claim")}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		pod        *v1.Pod
+		enabled    bool
+		wantStatus *framework.Status
+	}{
+		{name: "feature disabled: always skip", pod: podWithClaim, enabled: false, wantStatus: framework.NewStatus(framework.Skip)},
+		{name: "no ResourceClaims: skip", pod: podWithNoClaims, enabled: true, wantStatus: framework.NewStatus(framework.Skip)},
+		{name: "has a ResourceClaim: don't skip", pod: podWithClaim, enabled: true, wantStatus: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &DRALimits{enabled: test.enabled}
+			_, ctx := ktesting.NewTestContext(t)
+			_, gotStatus := p.PreFilter(ctx, nil, test.pod)
+			if !reflect.DeepEqual(gotStatus, test.wantStatus) {
+				t.Errorf("PreFilter status does not match: %v, want: %v", gotStatus, test.wantStatus)
+			}
+		})
+	}
+}
+
+func getNodeWithPodAndResourceClaims(limitSource string, pods []*v1.Pod, limit int64, driverNames ...string) (*framework.NodeInfo, []*resourceapi.ResourceSlice) {
+	nodeInfo := framework.NewNodeInfo(pods...)
+	nodeInfo.SetNode(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: draTestNodeName}})
+
+	var slices []*resourceapi.ResourceSlice
+	if limitSource == "node" {
+		for _, driver := range driverNames {
+			devices := make([]resourceapi.Device, limit)
+			for i := range devices {
+				devices[i] = resourceapi.Device{Name: fmt.Sprintf("dev-%d", i)}
+			}
+			slices = append(slices, &resourceapi.ResourceSlice{
+				ObjectMeta: metav1.ObjectMeta{Name: driver + "-slice"},
+				Spec: resourceapi.ResourceSliceSpec{
+					Driver:   driver,
+					NodeName: draTestNodeName,
+					Pool:     resourceapi.ResourcePool{Name: driver + "-pool", ResourceSliceCount: 1},
+					Devices:  devices,
+				},
+			})
+		}
+	}
+	return nodeInfo, slices
+}
+
+func getFakeResourceClaimLister(claims ...*resourceapi.ResourceClaim) resourcelisters.ResourceClaimLister {
+	return fakeResourceClaimLister(claims)
+}
+
+func getFakeResourceSliceLister(slices ...*resourceapi.ResourceSlice) resourcelisters.ResourceSliceLister {
+	return fakeResourceSliceLister(slices)
+}
+
+// fakeResourceClaimLister is a minimal ResourceClaimLister backed directly by a slice of
+// claims, in the same spirit as the tf.XLister fakes used by the CSI tests in csi_test.go, but
+// defined locally since this plugin introduces DRA lister usage to this package.
+type fakeResourceClaimLister []*resourceapi.ResourceClaim
+
+func (l fakeResourceClaimLister) List(selector labels.Selector) ([]*resourceapi.ResourceClaim, error) {
+	return l, nil
+}
+
+func (l fakeResourceClaimLister) ResourceClaims(namespace string) resourcelisters.ResourceClaimNamespaceLister {
+	return fakeResourceClaimNamespaceLister{namespace: namespace, claims: l}
+}
+
+type fakeResourceClaimNamespaceLister struct {
+	namespace string
+	claims    fakeResourceClaimLister
+}
+
+func (l fakeResourceClaimNamespaceLister) List(selector labels.Selector) ([]*resourceapi.ResourceClaim, error) {
+	var out []*resourceapi.ResourceClaim
+	for _, claim := range l.claims {
+		if claim.Namespace == l.namespace {
+			out = append(out, claim)
+		}
+	}
+	return out, nil
+}
+
+func (l fakeResourceClaimNamespaceLister) Get(name string) (*resourceapi.ResourceClaim, error) {
+	for _, claim := range l.claims {
+		if claim.Namespace == l.namespace && claim.Name == name {
+			return claim, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Group: resourceapi.GroupName, Resource: "resourceclaims"}, name)
+}
+
+// fakeResourceSliceLister is a minimal, cluster-scoped ResourceSliceLister backed
+// directly by a slice of ResourceSlices.
+type fakeResourceSliceLister []*resourceapi.ResourceSlice
+
+func (l fakeResourceSliceLister) List(selector labels.Selector) ([]*resourceapi.ResourceSlice, error) {
+	return l, nil
+}
+
+func (l fakeResourceSliceLister) Get(name string) (*resourceapi.ResourceSlice, error) {
+	for _, slice := range l {
+		if slice.Name == name {
+			return slice, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Group: resourceapi.GroupName, Resource: "resourceslices"}, name)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodevolumelimits
+
+import (
+	v1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+)
+
+// SimulateAttach reports whether pod's CSI-attachable volumes (PVC-backed, generic
+// ephemeral, or migrated in-tree inline) would fit a hypothetical node alongside
+// existing, given per-driver attach limits supplied directly by the caller instead of
+// being read from a CSINode object.
+//
+// This lets an out-of-tree autoscaler (e.g. Karpenter) ask "would this pending pod's
+// volumes fit an instance type I haven't created a Node for yet" using the attach
+// limits it already knows for that instance type, without duplicating the
+// PVC/ephemeral/inline-migration resolution logic CSILimits uses. perDriverUsage
+// reports the usage CSILimits would have counted for every driver pod touches,
+// whether or not the pod fits, so callers can reason about how close a borderline
+// node is.
+func SimulateAttach(
+	pod *v1.Pod,
+	existing []*v1.Pod,
+	driverLimits map[string]int64,
+	translator InTreeToCSITranslator,
+	pvcLister corelisters.PersistentVolumeClaimLister,
+	pvLister corelisters.PersistentVolumeLister,
+	scLister storagelisters.StorageClassLister,
+) (fits bool, perDriverUsage map[string]int64, err error) {
+	pl := &CSILimits{
+		pvLister:             pvLister,
+		pvcLister:            pvcLister,
+		scLister:             scLister,
+		randomVolumeIDPrefix: "simulate-attach",
+		translator:           translator,
+	}
+
+	newVolumes, status := pl.filterAttachableVolumes(pod, nil)
+	if !status.IsSuccess() {
+		return false, nil, status.AsError()
+	}
+
+	attachedVolumes := make(map[string]resolvedVolume)
+	for _, existingPod := range existing {
+		existingVolumes, status := pl.filterAttachableVolumes(existingPod, nil)
+		if !status.IsSuccess() {
+			// Same as CSILimits.Filter: a neighbor whose volumes can't be resolved
+			// is not counted, rather than failing the simulation for pod.
+			continue
+		}
+		for volumeHandle, rv := range existingVolumes {
+			attachedVolumes[volumeHandle] = rv
+		}
+	}
+
+	attachedCount := map[string]int64{}
+	for volumeHandle, rv := range attachedVolumes {
+		if _, ok := newVolumes[volumeHandle]; ok {
+			continue
+		}
+		attachedCount[rv.driverName]++
+	}
+
+	newCount := map[string]int64{}
+	for _, rv := range newVolumes {
+		newCount[rv.driverName]++
+	}
+
+	perDriverUsage = make(map[string]int64, len(newCount))
+	fits = true
+	for driverName, count := range newCount {
+		usage := count + attachedCount[driverName]
+		perDriverUsage[driverName] = usage
+		if limit, ok := driverLimits[driverName]; ok && usage > limit {
+			fits = false
+		}
+	}
+
+	return fits, perDriverUsage, nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodevolumelimits
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	csitrans "k8s.io/csi-translation-lib"
+	st "k8s.io/kubernetes/pkg/scheduler/testing"
+)
+
+func TestSimulateAttach(t *testing.T) {
+	csiEBSOneVolPod := st.MakePod().PVC("csi-ebs.csi.aws.com-0").Obj()
+	csiEBSTwoVolPod := st.MakePod().PVC("csi-ebs.csi.aws.com-1").PVC("csi-ebs.csi.aws.com-2").Obj()
+
+	tests := []struct {
+		name          string
+		pod           *v1.Pod
+		existing      []*v1.Pod
+		driverLimits  map[string]int64
+		wantFits      bool
+		wantDriverUse int64
+	}{
+		{
+			name:          "fits when driver limit has headroom",
+			pod:           csiEBSOneVolPod,
+			existing:      []*v1.Pod{csiEBSTwoVolPod},
+			driverLimits:  map[string]int64{ebsCSIDriverName: 4},
+			wantFits:      true,
+			wantDriverUse: 3,
+		},
+		{
+			name:          "doesn't fit when driver limit is exceeded",
+			pod:           csiEBSOneVolPod,
+			existing:      []*v1.Pod{csiEBSTwoVolPod},
+			driverLimits:  map[string]int64{ebsCSIDriverName: 2},
+			wantFits:      false,
+			wantDriverUse: 3,
+		},
+		{
+			name:          "no limit supplied for the driver: always fits",
+			pod:           csiEBSOneVolPod,
+			existing:      []*v1.Pod{csiEBSTwoVolPod},
+			driverLimits:  map[string]int64{},
+			wantFits:      true,
+			wantDriverUse: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fits, usage, err := SimulateAttach(
+				test.pod,
+				test.existing,
+				test.driverLimits,
+				csitrans.New(),
+				getFakeCSIPVCLister("csi", scName, ebsCSIDriverName),
+				getFakeCSIPVLister("csi", ebsCSIDriverName),
+				getFakeCSIStorageClassLister(ebsCSIDriverName, scName),
+			)
+			if err != nil {
+				t.Fatalf("SimulateAttach returned error: %v", err)
+			}
+			if fits != test.wantFits {
+				t.Errorf("fits = %v, want %v", fits, test.wantFits)
+			}
+			if usage[ebsCSIDriverName] != test.wantDriverUse {
+				t.Errorf("usage[%s] = %d, want %d", ebsCSIDriverName, usage[ebsCSIDriverName], test.wantDriverUse)
+			}
+		})
+	}
+}